@@ -0,0 +1,331 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Ben Bangert (bbangert@mozilla.com)
+#   Mike Trinkala (trink@mozilla.com)
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// conditionNode is a single node in a MatchCondition expression tree. Eval
+// resolves identifiers against captures (the same map Run builds from
+// match group captures, "Logger"/"Hostname"/"Type"/"Payload", and numeric
+// message fields).
+type conditionNode interface {
+	Eval(captures map[string]string) (bool, error)
+}
+
+type conditionLiteral bool
+
+func (c conditionLiteral) Eval(map[string]string) (bool, error) { return bool(c), nil }
+
+type conditionNot struct{ operand conditionNode }
+
+func (c *conditionNot) Eval(captures map[string]string) (bool, error) {
+	v, err := c.operand.Eval(captures)
+	if err != nil {
+		return false, err
+	}
+	return !v, nil
+}
+
+type conditionAnd struct{ left, right conditionNode }
+
+func (c *conditionAnd) Eval(captures map[string]string) (bool, error) {
+	l, err := c.left.Eval(captures)
+	if err != nil || !l {
+		return false, err
+	}
+	return c.right.Eval(captures)
+}
+
+type conditionOr struct{ left, right conditionNode }
+
+func (c *conditionOr) Eval(captures map[string]string) (bool, error) {
+	l, err := c.left.Eval(captures)
+	if err != nil || l {
+		return l, err
+	}
+	return c.right.Eval(captures)
+}
+
+// conditionCompare evaluates `left op right`, where left and right are
+// each either an identifier (resolved against captures) or a literal. If
+// both sides parse as numbers the comparison is numeric; otherwise it
+// falls back to a string comparison (only "==" and "!=" are meaningful
+// there).
+type conditionCompare struct {
+	op          string
+	left, right conditionOperand
+}
+
+type conditionOperand struct {
+	literal    bool
+	identifier string
+	value      string
+}
+
+func (o conditionOperand) resolve(captures map[string]string) string {
+	if o.literal {
+		return o.value
+	}
+	return captures[o.identifier]
+}
+
+func (c *conditionCompare) Eval(captures map[string]string) (bool, error) {
+	lhs := c.left.resolve(captures)
+	rhs := c.right.resolve(captures)
+
+	lf, lerr := strconv.ParseFloat(lhs, 64)
+	rf, rerr := strconv.ParseFloat(rhs, 64)
+	if lerr == nil && rerr == nil {
+		switch c.op {
+		case "==":
+			return lf == rf, nil
+		case "!=":
+			return lf != rf, nil
+		case "<":
+			return lf < rf, nil
+		case "<=":
+			return lf <= rf, nil
+		case ">":
+			return lf > rf, nil
+		case ">=":
+			return lf >= rf, nil
+		}
+	}
+
+	switch c.op {
+	case "==":
+		return lhs == rhs, nil
+	case "!=":
+		return lhs != rhs, nil
+	case "<":
+		return lhs < rhs, nil
+	case "<=":
+		return lhs <= rhs, nil
+	case ">":
+		return lhs > rhs, nil
+	case ">=":
+		return lhs >= rhs, nil
+	}
+	return false, fmt.Errorf("unknown operator: %s", c.op)
+}
+
+// conditionParser is a small recursive-descent parser for the
+// MatchCondition grammar:
+//
+//	orExpr    := andExpr ( "||" andExpr )*
+//	andExpr   := unary ( "&&" unary )*
+//	unary     := "!" unary | comparison
+//	comparison:= "(" orExpr ")" | operand ( compareOp operand )?
+//	operand   := STRING | NUMBER | IDENT
+type conditionParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseCondition(expr string) (conditionNode, error) {
+	tokens, err := tokenizeCondition(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &conditionParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected token: %s", p.tokens[p.pos])
+	}
+	return node, nil
+}
+
+func (p *conditionParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *conditionParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *conditionParser) parseOr() (conditionNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &conditionOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseAnd() (conditionNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &conditionAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseUnary() (conditionNode, error) {
+	if p.peek() == "!" {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &conditionNot{operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *conditionParser) parseComparison() (conditionNode, error) {
+	if p.peek() == "(" {
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("expected closing ')'")
+		}
+		return node, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.peek() {
+	case "==", "!=", "<", "<=", ">", ">=":
+		op := p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &conditionCompare{op: op, left: left, right: right}, nil
+	}
+
+	// A bare operand is truthy if it's non-empty and not "false"/"0".
+	return &left, nil
+}
+
+// conditionOperand doubles as a conditionNode so a bare identifier (e.g.
+// "Enabled" with no comparison operator) can be used as a predicate on its
+// own.
+func (o *conditionOperand) Eval(captures map[string]string) (bool, error) {
+	v := o.resolve(captures)
+	return v != "" && v != "0" && v != "false", nil
+}
+
+func (p *conditionParser) parseOperand() (conditionOperand, error) {
+	tok := p.next()
+	if tok == "" {
+		return conditionOperand{}, fmt.Errorf("unexpected end of expression")
+	}
+	if strings.HasPrefix(tok, `"`) {
+		return conditionOperand{literal: true, value: strings.Trim(tok, `"`)}, nil
+	}
+	if _, err := strconv.ParseFloat(tok, 64); err == nil {
+		return conditionOperand{literal: true, value: tok}, nil
+	}
+	return conditionOperand{identifier: tok}, nil
+}
+
+// tokenizeCondition splits a MatchCondition expression into operator,
+// identifier, string-literal, and number-literal tokens.
+func tokenizeCondition(expr string) ([]string, error) {
+	var tokens []string
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(expr) && expr[j] != '"' {
+				j++
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated string literal in condition")
+			}
+			tokens = append(tokens, expr[i:j+1])
+			i = j + 1
+		case strings.HasPrefix(expr[i:], "&&"):
+			tokens = append(tokens, "&&")
+			i += 2
+		case strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, "||")
+			i += 2
+		case strings.HasPrefix(expr[i:], "=="):
+			tokens = append(tokens, "==")
+			i += 2
+		case strings.HasPrefix(expr[i:], "!="):
+			tokens = append(tokens, "!=")
+			i += 2
+		case strings.HasPrefix(expr[i:], "<="):
+			tokens = append(tokens, "<=")
+			i += 2
+		case strings.HasPrefix(expr[i:], ">="):
+			tokens = append(tokens, ">=")
+			i += 2
+		case c == '<' || c == '>':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '!':
+			tokens = append(tokens, "!")
+			i++
+		default:
+			j := i
+			for j < len(expr) && !strings.ContainsRune(" \t()!<>=\"", rune(expr[j])) &&
+				!strings.HasPrefix(expr[j:], "&&") && !strings.HasPrefix(expr[j:], "||") {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected character %q in condition", expr[i])
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,109 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Ben Bangert (bbangert@mozilla.com)
+#   Mike Trinkala (trink@mozilla.com)
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import "testing"
+
+func TestParseConditionComparisons(t *testing.T) {
+	tests := []struct {
+		expr     string
+		captures map[string]string
+		want     bool
+	}{
+		{`Status == "500"`, map[string]string{"Status": "500"}, true},
+		{`Status == "500"`, map[string]string{"Status": "404"}, false},
+		{`Status >= "500"`, map[string]string{"Status": "503"}, true},
+		{`Status >= "500"`, map[string]string{"Status": "404"}, false},
+		{`Status < "500"`, map[string]string{"Status": "200"}, true},
+		{`Method == "POST"`, map[string]string{"Method": "GET"}, false},
+	}
+	for _, tc := range tests {
+		cond, err := parseCondition(tc.expr)
+		if err != nil {
+			t.Fatalf("parseCondition(%q) returned error: %s", tc.expr, err)
+		}
+		got, err := cond.Eval(tc.captures)
+		if err != nil {
+			t.Fatalf("Eval(%q) returned error: %s", tc.expr, err)
+		}
+		if got != tc.want {
+			t.Errorf("Eval(%q) with %v = %v, want %v", tc.expr, tc.captures, got, tc.want)
+		}
+	}
+}
+
+func TestParseConditionLogicalOperators(t *testing.T) {
+	captures := map[string]string{"Status": "500", "Method": "POST"}
+
+	cond, err := parseCondition(`Status >= "500" && Method == "POST"`)
+	if err != nil {
+		t.Fatalf("parseCondition returned error: %s", err)
+	}
+	if got, _ := cond.Eval(captures); !got {
+		t.Errorf("expected && condition to match, got false")
+	}
+
+	cond, err = parseCondition(`Status >= "500" && Method == "GET"`)
+	if err != nil {
+		t.Fatalf("parseCondition returned error: %s", err)
+	}
+	if got, _ := cond.Eval(captures); got {
+		t.Errorf("expected && condition to fail, got true")
+	}
+
+	cond, err = parseCondition(`Status < "500" || Method == "POST"`)
+	if err != nil {
+		t.Fatalf("parseCondition returned error: %s", err)
+	}
+	if got, _ := cond.Eval(captures); !got {
+		t.Errorf("expected || condition to match, got false")
+	}
+
+	cond, err = parseCondition(`!(Method == "GET")`)
+	if err != nil {
+		t.Fatalf("parseCondition returned error: %s", err)
+	}
+	if got, _ := cond.Eval(captures); !got {
+		t.Errorf("expected negated condition to match, got false")
+	}
+}
+
+func TestParseConditionNumericVsString(t *testing.T) {
+	// "10" < "9" numerically is false, but would be true as a plain string
+	// comparison; make sure numeric comparison wins when both sides parse
+	// as numbers.
+	cond, err := parseCondition(`Count > "9"`)
+	if err != nil {
+		t.Fatalf("parseCondition returned error: %s", err)
+	}
+	got, err := cond.Eval(map[string]string{"Count": "10"})
+	if err != nil {
+		t.Fatalf("Eval returned error: %s", err)
+	}
+	if !got {
+		t.Errorf("expected numeric comparison 10 > 9 to be true")
+	}
+}
+
+func TestParseConditionInvalidExpression(t *testing.T) {
+	if _, err := parseCondition(`Status >= `); err == nil {
+		t.Errorf("expected error for incomplete expression, got nil")
+	}
+	if _, err := parseCondition(`Status >= "500" )`); err == nil {
+		t.Errorf("expected error for unbalanced parens, got nil")
+	}
+}
@@ -0,0 +1,143 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Ben Bangert (bbangert@mozilla.com)
+#   Mike Trinkala (trink@mozilla.com)
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Stat represents a single statsd-style metric value, as produced by
+// StatFilter or received directly over the wire by a StatsdInput. It
+// carries everything needed to render the line a networked statsd client
+// would have sent: `bucket:value|type[|@rate][|#tags]`.
+type Stat struct {
+	Bucket   string
+	Value    string
+	Modifier string
+	// SampleRate this stat was collected at, in (0, 1]. 1 (the default)
+	// means unsampled and is never rendered; anything less is rendered as
+	// a `|@rate` suffix so whatever consumes the rendered line can scale
+	// its counts back up.
+	SampleRate float64
+	// Optional DogStatsD-style dimensional tags, each already formatted as
+	// "key:value". When present the stat is rendered in DogStatsD wire
+	// format (`|#k1:v1,k2:v2` suffix); when empty it falls back to plain
+	// statsd.
+	Tags []string
+}
+
+// String renders the stat in wire format:
+// `bucket:value|type` with optional `|@rate` and `|#tags` suffixes, the
+// latter only present when Tags is non-empty (DogStatsD), otherwise
+// falling back to plain statsd.
+func (s Stat) String() string {
+	rate := s.SampleRate
+	if rate == 0 {
+		rate = 1
+	}
+	line := fmt.Sprintf("%s:%s|%s", s.Bucket, s.Value, s.Modifier)
+	if rate < 1 {
+		line += fmt.Sprintf("|@%g", rate)
+	}
+	if len(s.Tags) > 0 {
+		line += "|#" + strings.Join(s.Tags, ",")
+	}
+	return line
+}
+
+// StatAccumulator is implemented by input plugins (such as
+// StatAccumInput) that can accept Stats generated by a StatFilter in place
+// of the raw client packets a networked statsd listener would receive.
+type StatAccumulator interface {
+	// DropStat delivers a single Stat for accumulation. Returns false if
+	// the stat could not be accepted.
+	DropStat(stat Stat) bool
+}
+
+// StatAccumInput is a Heka Input plugin that acts as the counterpart to a
+// networked statsd listener: it accepts Stats handed to it by one or more
+// StatFilters (rather than raw UDP packets) and, on Flush, renders each one
+// in the wire format a statsd-compatible backend expects. Stats are passed
+// through one line each; counter, timer and gauge values are not
+// aggregated here, and sample rates are rendered rather than applied.
+type StatAccumInput struct {
+	statChan chan Stat
+	pending  []string
+
+	sync.Mutex
+}
+
+// StatAccumInput config struct.
+type StatAccumInputConfig struct {
+	// Size of the channel used to receive Stats from StatFilters. Defaults
+	// to 1000.
+	StatChanSize int `toml:"stat_chan_size"`
+}
+
+func (input *StatAccumInput) ConfigStruct() interface{} {
+	return &StatAccumInputConfig{
+		StatChanSize: 1000,
+	}
+}
+
+func (input *StatAccumInput) Init(config interface{}) (err error) {
+	conf := config.(*StatAccumInputConfig)
+	input.statChan = make(chan Stat, conf.StatChanSize)
+	return
+}
+
+// DropStat implements the StatAccumulator interface. It queues the stat,
+// unrendered, on the input's stat channel for the next Flush, which renders
+// it to wire format. It returns false without blocking when the channel is
+// full.
+func (input *StatAccumInput) DropStat(stat Stat) bool {
+	select {
+	case input.statChan <- stat:
+		return true
+	default:
+		return false
+	}
+}
+
+// Flush drains any Stats received since the last Flush and returns them
+// joined into a single statsd packet body, one stat per line.
+func (input *StatAccumInput) Flush() string {
+	input.Lock()
+	defer input.Unlock()
+
+	drain := true
+	for drain {
+		select {
+		case stat := <-input.statChan:
+			input.pending = append(input.pending, stat.String())
+		default:
+			drain = false
+		}
+	}
+
+	body := ""
+	for i, line := range input.pending {
+		if i > 0 {
+			body += "\n"
+		}
+		body += line
+	}
+	input.pending = input.pending[:0]
+	return body
+}
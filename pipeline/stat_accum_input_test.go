@@ -0,0 +1,105 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Ben Bangert (bbangert@mozilla.com)
+#   Mike Trinkala (trink@mozilla.com)
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import "testing"
+
+func TestStatStringPlain(t *testing.T) {
+	s := Stat{Bucket: "my.counter", Value: "1", Modifier: ""}
+	if got, want := s.String(), "my.counter:1|"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestStatStringOmitsUnsampledRate(t *testing.T) {
+	s := Stat{Bucket: "my.counter", Value: "1", Modifier: "", SampleRate: 1}
+	if got, want := s.String(), "my.counter:1|"; got != want {
+		t.Errorf("String() = %q, want %q (SampleRate 1 should not be rendered)", got, want)
+	}
+
+	s.SampleRate = 0
+	if got, want := s.String(), "my.counter:1|"; got != want {
+		t.Errorf("String() = %q, want %q (zero-value SampleRate should default to unsampled)", got, want)
+	}
+}
+
+func TestStatStringRendersSampleRate(t *testing.T) {
+	s := Stat{Bucket: "my.counter", Value: "1", Modifier: "c", SampleRate: 0.1}
+	if got, want := s.String(), "my.counter:1|c|@0.1"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestStatStringRendersDogStatsDTags(t *testing.T) {
+	s := Stat{
+		Bucket:   "my.timer",
+		Value:    "42",
+		Modifier: "ms",
+		Tags:     []string{"host:web1", "env:prod"},
+	}
+	if got, want := s.String(), "my.timer:42|ms|#host:web1,env:prod"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestStatStringRendersRateAndTagsTogether(t *testing.T) {
+	s := Stat{
+		Bucket:     "my.timer",
+		Value:      "42",
+		Modifier:   "ms",
+		SampleRate: 0.5,
+		Tags:       []string{"host:web1"},
+	}
+	if got, want := s.String(), "my.timer:42|ms|@0.5|#host:web1"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestDropStatAndFlush(t *testing.T) {
+	input := &StatAccumInput{}
+	if err := input.Init(input.ConfigStruct()); err != nil {
+		t.Fatalf("Init returned error: %s", err)
+	}
+
+	if ok := input.DropStat(Stat{Bucket: "a", Value: "1", Modifier: ""}); !ok {
+		t.Fatalf("expected DropStat to accept a stat under capacity")
+	}
+	if ok := input.DropStat(Stat{Bucket: "b", Value: "2", Modifier: "g"}); !ok {
+		t.Fatalf("expected DropStat to accept a stat under capacity")
+	}
+
+	if got, want := input.Flush(), "a:1|\nb:2|g"; got != want {
+		t.Errorf("Flush() = %q, want %q", got, want)
+	}
+	if got := input.Flush(); got != "" {
+		t.Errorf("expected a second Flush() with nothing pending to be empty, got %q", got)
+	}
+}
+
+func TestDropStatFullChannelReturnsFalse(t *testing.T) {
+	input := &StatAccumInput{}
+	if err := input.Init(&StatAccumInputConfig{StatChanSize: 1}); err != nil {
+		t.Fatalf("Init returned error: %s", err)
+	}
+
+	if ok := input.DropStat(Stat{Bucket: "a", Value: "1"}); !ok {
+		t.Fatalf("expected the first DropStat to succeed")
+	}
+	if ok := input.DropStat(Stat{Bucket: "b", Value: "2"}); ok {
+		t.Errorf("expected DropStat to report failure once the channel is full")
+	}
+}
@@ -18,15 +18,55 @@ package pipeline
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
 	"github.com/mozilla-services/heka/message"
 )
 
+// Matches a "%Name%" or "%Name:spec%" interpolation token, where spec is a
+// printf-style format verb (without the leading '%') such as ".3f" or "d".
+var valueTokenMatcher = regexp.MustCompile(`%([A-Za-z0-9_]+)(?::([^%]+))?%`)
+
 // Simple struct representing a single statsd-style metric value.
 type metric struct {
-	// Supports "Counter", "Timer", or "Gauge"
+	// Supports "Counter", "Timer", "Gauge", "Set", or "Histogram"
 	Type_ string `toml:"type"`
 	Name  string
 	Value string
+	// Sample rate to apply to the emitted stat, in the range (0, 1]. Only
+	// valid for "Counter", "Timer", "Gauge", and "Histogram" types; "Set"
+	// stats are always sent unsampled. Defaults to 1 (no sampling) when
+	// unset.
+	SampleRate float64
+	// Optional set of dimensional tags to attach to the stat. Tag values go
+	// through the same InterpolateString treatment as Name and Value, so a
+	// regex match group captured in `plc.Captures` can be used as a tag
+	// value without having to be baked into the bucket name.
+	Tags map[string]string
+	// Optional server-side aggregation for a "Timer" metric. When set, raw
+	// samples are no longer forwarded to the accumulator; instead they're
+	// folded into a per-bucket aggregator and derived stats are emitted on
+	// the filter's ticker interval.
+	TimerAggregation *TimerAggregationConfig
+	// Optional factor applied to any numeric capture interpolated into
+	// Value, e.g. 1000 to convert a seconds-denominated field into the
+	// milliseconds a "Timer" metric expects. Defaults to 1 (no scaling).
+	Multiplier float64
+	// Optional message Type that must match the current pack for this
+	// metric to be emitted. Empty means match any type.
+	MatchType string
+	// Optional message Logger that must match the current pack for this
+	// metric to be emitted. Empty means match any logger.
+	MatchLogger string
+	// Optional boolean expression over captures and numeric message fields,
+	// e.g. `Status >= "500" && Method == "POST"`. Only emitted when it
+	// evaluates true. Supports ==, !=, <, <=, >, >=, &&, ||, and !, with
+	// string and numeric literals. Parsed once at Init time.
+	MatchCondition string
+
+	condition conditionNode
 }
 
 // Heka Filter plugin that can accept specific message types, extract data
@@ -36,6 +76,10 @@ type metric struct {
 type StatFilter struct {
 	metrics       map[string]metric
 	statAccumName string
+	// One aggregatorSet per metric id that configured TimerAggregation,
+	// tracking aggregators for each interpolated bucket name that metric
+	// has produced.
+	aggregators map[string]*aggregatorSet
 }
 
 // StatFilter config struct.
@@ -56,18 +100,167 @@ func (s *StatFilter) ConfigStruct() interface{} {
 
 func (s *StatFilter) Init(config interface{}) (err error) {
 	conf := config.(*StatFilterConfig)
+	s.aggregators = make(map[string]*aggregatorSet)
+	for name, met := range conf.Metric {
+		if met.Multiplier == 0 {
+			met.Multiplier = 1
+			conf.Metric[name] = met
+		}
+		switch met.Type_ {
+		case "Set":
+			// Sets are always sent unsampled; a configured rate would only
+			// be misleading since the accumulator can't "de-sample" a
+			// cardinality estimate.
+			met.SampleRate = 1
+			conf.Metric[name] = met
+		case "Counter", "Timer", "Histogram", "Gauge":
+			if met.SampleRate == 0 {
+				met.SampleRate = 1
+				conf.Metric[name] = met
+			} else if met.SampleRate < 0 || met.SampleRate > 1 {
+				return fmt.Errorf("metric '%s' has an invalid sample rate: %f, "+
+					"must be in (0, 1]", name, met.SampleRate)
+			}
+		}
+
+		if met.MatchCondition != "" {
+			cond, err := parseCondition(met.MatchCondition)
+			if err != nil {
+				return fmt.Errorf("metric '%s' has an invalid match_condition: %s",
+					name, err)
+			}
+			met.condition = cond
+			conf.Metric[name] = met
+		}
+
+		if met.TimerAggregation != nil {
+			if met.Type_ != "Timer" {
+				return fmt.Errorf("metric '%s' sets timer_aggregation but is not "+
+					"a Timer", name)
+			}
+			agg := met.TimerAggregation
+			if len(agg.Quantiles) > 0 == agg.isHistogram() {
+				return fmt.Errorf("metric '%s' timer_aggregation must set exactly "+
+					"one of quantiles or buckets", name)
+			}
+			for _, q := range agg.Quantiles {
+				if q.Quantile < 0 || q.Quantile > 1 {
+					return fmt.Errorf("metric '%s' has an invalid quantile: %f, "+
+						"must be in [0, 1]", name, q.Quantile)
+				}
+			}
+			s.aggregators[name] = newAggregatorSet(agg)
+		}
+	}
 	s.metrics = conf.Metric
 	s.statAccumName = conf.StatAccumName
 	return
 }
 
+// interpolateValue is InterpolateString's counterpart for a metric's Value
+// template. It supports the same "%Name%" substitution, but additionally
+// recognizes "%Name:spec%" where spec is a printf format verb (e.g. ".3f"
+// or "d") applied to the captured value, and scales any interpolated
+// numeric capture by multiplier before formatting it.
+func interpolateValue(template string, captures map[string]string, multiplier float64) string {
+	return valueTokenMatcher.ReplaceAllStringFunc(template, func(token string) string {
+		match := valueTokenMatcher.FindStringSubmatch(token)
+		name, spec := match[1], match[2]
+		value, ok := captures[name]
+		if !ok {
+			return token
+		}
+		if multiplier != 1 {
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				value = strconv.FormatFloat(f*multiplier, 'g', -1, 64)
+			}
+		}
+		return formatValue(value, spec)
+	})
+}
+
+// formatValue applies a printf format verb, such as "d" or ".3f", to a
+// numeric string value. An empty spec, or a value that doesn't parse as a
+// number, is returned unchanged.
+func formatValue(value, spec string) string {
+	if spec == "" {
+		return value
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+	switch spec[len(spec)-1] {
+	case 'd':
+		// Go's fmt has no float-to-%d verb, so convert to int64 first, but
+		// keep any width/flag prefix (e.g. the "05" in "05d") intact.
+		return fmt.Sprintf("%"+spec[:len(spec)-1]+"d", int64(f))
+	default:
+		return fmt.Sprintf("%"+spec, f)
+	}
+}
+
+// statForMetric builds the Stat a metric should emit for a message whose
+// captures, Type, and Logger are given, or reports that the metric should be
+// skipped because its MatchType, MatchLogger, or MatchCondition doesn't hold.
+// Pulled out of Run as its own function so the modifier mapping and Tags
+// assembly can be unit tested without a running FilterRunner.
+func statForMetric(met metric, captures map[string]string, msgType, msgLogger string) (stat Stat, skip bool, err error) {
+	if met.MatchType != "" && met.MatchType != msgType {
+		return Stat{}, true, nil
+	}
+	if met.MatchLogger != "" && met.MatchLogger != msgLogger {
+		return Stat{}, true, nil
+	}
+	if met.condition != nil {
+		matched, err := met.condition.Eval(captures)
+		if err != nil {
+			return Stat{}, false, err
+		}
+		if !matched {
+			return Stat{}, true, nil
+		}
+	}
+
+	stat.Bucket = InterpolateString(met.Name, captures)
+	switch met.Type_ {
+	case "Counter":
+		stat.Modifier = ""
+	case "Timer":
+		stat.Modifier = "ms"
+	case "Gauge":
+		stat.Modifier = "g"
+	case "Set":
+		stat.Modifier = "s"
+	case "Histogram":
+		stat.Modifier = "h"
+	}
+	stat.Value = interpolateValue(met.Value, captures, met.Multiplier)
+	stat.SampleRate = met.SampleRate
+	if len(met.Tags) > 0 {
+		stat.Tags = make([]string, 0, len(met.Tags))
+		for k, v := range met.Tags {
+			stat.Tags = append(stat.Tags, fmt.Sprintf("%s:%s",
+				k, InterpolateString(v, captures)))
+		}
+	}
+	return stat, false, nil
+}
+
 // For each message, we first extract any match group captures, and then we
 // add our own values for "Logger", "Hostname", "Type", and "Payload" as if
 // they were captured values. We then iterate through all of this plugin's
 // defined metrics, and for each one we use the captures to do string
 // substitution on both the name and the payload. For example, a metric with
 // the name "@Hostname.404s" would become a stat with the "@Hostname" replaced
-// by the hostname from the received message.
+// by the hostname from the received message. Integer, double, and boolean
+// fields are captured too, not just strings, so a Value template like
+// "%SomeCount%" can reference them directly. Any configured tags go through
+// the same substitution and are attached to the stat so the accumulator can
+// emit it in DogStatsD wire format. A metric whose MatchType, MatchLogger,
+// or MatchCondition doesn't hold for the current message is skipped, so a
+// single StatFilter can emit different metrics for different messages
+// instead of requiring one StatFilter per message_matcher variant.
 func (s *StatFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 	var (
 		statAccumInput InputRunner
@@ -84,47 +277,99 @@ func (s *StatFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 	var (
 		pack     *PipelinePack
 		captures map[string]string
-		stat     Stat
 	)
 
 	inChan := fr.InChan()
-	for plc := range inChan {
-		pack = plc.Pack
-		captures = plc.Captures
-		if captures == nil {
-			captures = make(map[string]string)
-		}
+	ticker := fr.Ticker()
 
-		// Load existing fields into the set for replacement
-		captures["Logger"] = pack.Message.GetLogger()
-		captures["Hostname"] = pack.Message.GetHostname()
-		captures["Type"] = pack.Message.GetType()
-		captures["Payload"] = pack.Message.GetPayload()
+	for {
+		select {
+		case plc, ok := <-inChan:
+			if !ok {
+				return s.flush(statAccum, fr, time.Now())
+			}
+			pack = plc.Pack
+			captures = plc.Captures
+			if captures == nil {
+				captures = make(map[string]string)
+			}
+
+			// Load existing fields into the set for replacement
+			captures["Logger"] = pack.Message.GetLogger()
+			captures["Hostname"] = pack.Message.GetHostname()
+			captures["Type"] = pack.Message.GetType()
+			captures["Payload"] = pack.Message.GetPayload()
 
-		for _, field := range pack.Message.Fields {
-			if field.GetValueType() == message.Field_STRING && len(field.ValueString) > 0 {
-				captures[field.GetName()] = field.ValueString[0]
+			for _, field := range pack.Message.Fields {
+				switch field.GetValueType() {
+				case message.Field_STRING:
+					if len(field.ValueString) > 0 {
+						captures[field.GetName()] = field.ValueString[0]
+					}
+				case message.Field_INTEGER:
+					if len(field.ValueInteger) > 0 {
+						captures[field.GetName()] = strconv.FormatInt(field.ValueInteger[0], 10)
+					}
+				case message.Field_DOUBLE:
+					if len(field.ValueDouble) > 0 {
+						captures[field.GetName()] = strconv.FormatFloat(field.ValueDouble[0], 'g', -1, 64)
+					}
+				case message.Field_BOOL:
+					if len(field.ValueBool) > 0 {
+						captures[field.GetName()] = strconv.FormatBool(field.ValueBool[0])
+					}
+				}
 			}
-		}
 
-		// We matched, generate appropriate metrics
-		for _, met := range s.metrics {
-			stat.Bucket = InterpolateString(met.Name, captures)
-			switch met.Type_ {
-			case "Counter":
-				stat.Modifier = ""
-			case "Timer":
-				stat.Modifier = "ms"
-			case "Gauge":
-				stat.Modifier = "g"
+			// We matched, generate appropriate metrics
+			for name, met := range s.metrics {
+				stat, skip, err := statForMetric(met, captures,
+					pack.Message.GetType(), pack.Message.GetLogger())
+				if err != nil {
+					fr.LogError(fmt.Errorf("Error evaluating match_condition for "+
+						"metric '%s': %s", name, err))
+					continue
+				}
+				if skip {
+					continue
+				}
+
+				if aggSet, ok := s.aggregators[name]; ok {
+					value, err := strconv.ParseFloat(stat.Value, 64)
+					if err != nil {
+						fr.LogError(fmt.Errorf("Non-numeric value for aggregated "+
+							"timer '%s': %s", stat.Bucket, stat.Value))
+						continue
+					}
+					aggSet.get(stat.Bucket, time.Now()).Add(value)
+					continue
+				}
+
+				if !statAccum.DropStat(stat) {
+					fr.LogError(fmt.Errorf("Undelivered stat: %s", stat))
+				}
+			}
+			pack.Recycle()
+
+		case t := <-ticker:
+			if err = s.flush(statAccum, fr, t); err != nil {
+				return
 			}
-			stat.Value = InterpolateString(met.Value, captures)
+		}
+	}
+}
+
+// flush drains every configured timer aggregator, emitting their derived
+// stats to the accumulator. It's invoked on every tick, and once more as
+// the filter shuts down so that samples collected since the last tick
+// aren't silently lost.
+func (s *StatFilter) flush(statAccum StatAccumulator, fr FilterRunner, now time.Time) (err error) {
+	for _, aggSet := range s.aggregators {
+		for _, stat := range aggSet.flushAll(now) {
 			if !statAccum.DropStat(stat) {
 				fr.LogError(fmt.Errorf("Undelivered stat: %s", stat))
 			}
 		}
-		pack.Recycle()
 	}
-
 	return
 }
@@ -0,0 +1,190 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Ben Bangert (bbangert@mozilla.com)
+#   Mike Trinkala (trink@mozilla.com)
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import "testing"
+
+func TestInitDefaultsSampleRateByType(t *testing.T) {
+	for _, typ := range []string{"Counter", "Timer", "Histogram", "Gauge"} {
+		conf := &StatFilterConfig{
+			Metric: map[string]metric{"m": {Type_: typ, Name: "x", Value: "1"}},
+		}
+		s := &StatFilter{}
+		if err := s.Init(conf); err != nil {
+			t.Fatalf("Init(%s) returned error: %s", typ, err)
+		}
+		if got := s.metrics["m"].SampleRate; got != 1 {
+			t.Errorf("%s: expected default SampleRate 1, got %v", typ, got)
+		}
+	}
+}
+
+func TestInitSetIgnoresConfiguredSampleRate(t *testing.T) {
+	conf := &StatFilterConfig{
+		Metric: map[string]metric{"m": {Type_: "Set", Name: "x", Value: "1", SampleRate: 0.5}},
+	}
+	s := &StatFilter{}
+	if err := s.Init(conf); err != nil {
+		t.Fatalf("Init returned error: %s", err)
+	}
+	if got := s.metrics["m"].SampleRate; got != 1 {
+		t.Errorf("expected Set SampleRate to be forced to 1, got %v", got)
+	}
+}
+
+func TestInitRejectsInvalidSampleRate(t *testing.T) {
+	conf := &StatFilterConfig{
+		Metric: map[string]metric{"m": {Type_: "Counter", Name: "x", Value: "1", SampleRate: 1.5}},
+	}
+	s := &StatFilter{}
+	if err := s.Init(conf); err == nil {
+		t.Errorf("expected an error for an out-of-range sample rate")
+	}
+}
+
+func TestInitDefaultsMultiplier(t *testing.T) {
+	conf := &StatFilterConfig{
+		Metric: map[string]metric{"m": {Type_: "Counter", Name: "x", Value: "1"}},
+	}
+	s := &StatFilter{}
+	if err := s.Init(conf); err != nil {
+		t.Fatalf("Init returned error: %s", err)
+	}
+	if got := s.metrics["m"].Multiplier; got != 1 {
+		t.Errorf("expected default Multiplier 1, got %v", got)
+	}
+}
+
+func TestStatForMetricModifierByType(t *testing.T) {
+	tests := []struct {
+		typ      string
+		modifier string
+	}{
+		{"Counter", ""},
+		{"Timer", "ms"},
+		{"Gauge", "g"},
+		{"Set", "s"},
+		{"Histogram", "h"},
+	}
+	for _, tc := range tests {
+		met := metric{Type_: tc.typ, Name: "bucket", Value: "1", Multiplier: 1}
+		stat, skip, err := statForMetric(met, map[string]string{}, "", "")
+		if err != nil {
+			t.Fatalf("%s: statForMetric returned error: %s", tc.typ, err)
+		}
+		if skip {
+			t.Fatalf("%s: expected metric not to be skipped", tc.typ)
+		}
+		if stat.Modifier != tc.modifier {
+			t.Errorf("%s: expected modifier %q, got %q", tc.typ, tc.modifier, stat.Modifier)
+		}
+	}
+}
+
+func TestStatForMetricMatchTypeSkip(t *testing.T) {
+	met := metric{Type_: "Counter", Name: "bucket", Value: "1", Multiplier: 1, MatchType: "logfile"}
+
+	if _, skip, err := statForMetric(met, map[string]string{}, "logfile", ""); err != nil || skip {
+		t.Errorf("expected a matching Type not to be skipped, skip=%v err=%v", skip, err)
+	}
+	if _, skip, err := statForMetric(met, map[string]string{}, "other", ""); err != nil || !skip {
+		t.Errorf("expected a mismatched Type to be skipped, skip=%v err=%v", skip, err)
+	}
+}
+
+func TestStatForMetricMatchLoggerSkip(t *testing.T) {
+	met := metric{Type_: "Counter", Name: "bucket", Value: "1", Multiplier: 1, MatchLogger: "nginx"}
+
+	if _, skip, err := statForMetric(met, map[string]string{}, "", "nginx"); err != nil || skip {
+		t.Errorf("expected a matching Logger not to be skipped, skip=%v err=%v", skip, err)
+	}
+	if _, skip, err := statForMetric(met, map[string]string{}, "", "other"); err != nil || !skip {
+		t.Errorf("expected a mismatched Logger to be skipped, skip=%v err=%v", skip, err)
+	}
+}
+
+func TestStatForMetricMatchConditionSkip(t *testing.T) {
+	met := metric{Type_: "Counter", Name: "bucket", Value: "1", Multiplier: 1}
+	cond, err := parseCondition(`Status >= "500"`)
+	if err != nil {
+		t.Fatalf("parseCondition returned error: %s", err)
+	}
+	met.condition = cond
+
+	if _, skip, err := statForMetric(met, map[string]string{"Status": "503"}, "", ""); err != nil || skip {
+		t.Errorf("expected a matching condition not to be skipped, skip=%v err=%v", skip, err)
+	}
+	if _, skip, err := statForMetric(met, map[string]string{"Status": "200"}, "", ""); err != nil || !skip {
+		t.Errorf("expected a failing condition to be skipped, skip=%v err=%v", skip, err)
+	}
+}
+
+func TestStatForMetricTagsAssembly(t *testing.T) {
+	met := metric{
+		Type_:      "Counter",
+		Name:       "bucket",
+		Value:      "1",
+		Multiplier: 1,
+		Tags:       map[string]string{"host": "%Hostname%"},
+	}
+	stat, skip, err := statForMetric(met, map[string]string{"Hostname": "web1"}, "", "")
+	if err != nil || skip {
+		t.Fatalf("statForMetric failed unexpectedly: skip=%v err=%v", skip, err)
+	}
+	if len(stat.Tags) != 1 || stat.Tags[0] != "host:web1" {
+		t.Errorf("expected Tags [\"host:web1\"], got %v", stat.Tags)
+	}
+}
+
+func TestStatForMetricNoTagsLeavesTagsNil(t *testing.T) {
+	met := metric{Type_: "Counter", Name: "bucket", Value: "1", Multiplier: 1}
+	stat, _, err := statForMetric(met, map[string]string{}, "", "")
+	if err != nil {
+		t.Fatalf("statForMetric returned error: %s", err)
+	}
+	if stat.Tags != nil {
+		t.Errorf("expected nil Tags when no Tags are configured, got %v", stat.Tags)
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		value, spec, want string
+	}{
+		{"7", "", "7"},
+		{"7", "d", "7"},
+		{"7", "05d", "00007"},
+		{"3.14159", ".3f", "3.142"},
+		{"not-a-number", "05d", "not-a-number"},
+	}
+	for _, tc := range tests {
+		if got := formatValue(tc.value, tc.spec); got != tc.want {
+			t.Errorf("formatValue(%q, %q) = %q, want %q", tc.value, tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestStatForMetricValueUsesMultiplier(t *testing.T) {
+	met := metric{Type_: "Timer", Name: "bucket", Value: "%Elapsed:d%", Multiplier: 1000}
+	stat, _, err := statForMetric(met, map[string]string{"Elapsed": "0.25"}, "", "")
+	if err != nil {
+		t.Fatalf("statForMetric returned error: %s", err)
+	}
+	if stat.Value != "250" {
+		t.Errorf("expected Multiplier-scaled value \"250\", got %q", stat.Value)
+	}
+}
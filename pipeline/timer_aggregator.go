@@ -0,0 +1,308 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Ben Bangert (bbangert@mozilla.com)
+#   Mike Trinkala (trink@mozilla.com)
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Describes a single quantile the summary aggregator should track, e.g.
+// {Quantile: 0.99, Error: 0.001} for a p99 with 0.1% rank error tolerance.
+type QuantileSpec struct {
+	Quantile float64 `toml:"quantile"`
+	Error    float64 `toml:"error"`
+}
+
+// TimerAggregation configures server-side aggregation of a Timer metric so
+// individual samples no longer have to be shipped (and stored) one at a
+// time. A metric picks exactly one of the two modes:
+//
+//   - Quantiles: summary mode, tracked with a sliding window of decaying
+//     age buckets so that samples older than MaxAge stop influencing the
+//     result.
+//   - Buckets: histogram mode, a fixed set of cumulative bucket upper
+//     bounds.
+type TimerAggregationConfig struct {
+	// Summary mode: quantiles to compute, each with its own rank error
+	// tolerance.
+	Quantiles []QuantileSpec `toml:"quantiles"`
+	// Summary mode: age, in seconds, after which a sample is evicted from
+	// the sliding window. Defaults to 600 (10 minutes).
+	MaxAge int `toml:"max_age"`
+	// Summary mode: number of rotating age buckets the MaxAge window is
+	// split into. More buckets means smoother decay at the cost of more
+	// bookkeeping. Defaults to 5.
+	AgeBuckets int `toml:"age_buckets"`
+	// Summary mode: number of samples retained per age bucket before the
+	// oldest are evicted to bound memory use. Defaults to 500. Raised to
+	// 1/Error of the tightest configured quantile when that is larger.
+	StreamBufferSize int `toml:"stream_buffer_size"`
+	// Histogram mode: cumulative bucket upper bounds, e.g.
+	// [0.01, 0.025, 0.05, 0.1, ...]. A final "+Inf" bucket is implicit.
+	Buckets []float64 `toml:"buckets"`
+	// Upper bound on the number of distinct interpolated bucket names this
+	// metric will track aggregators for. Once exceeded, the
+	// least-recently-used bucket name is evicted. Defaults to 10000.
+	MaxCardinality int `toml:"max_cardinality"`
+}
+
+func (c *TimerAggregationConfig) isHistogram() bool {
+	return len(c.Buckets) > 0
+}
+
+// timerAggregator accumulates Timer samples for a single interpolated
+// bucket name and, on flush, derives a slice of Stats to emit in place of
+// the raw per-sample stream.
+type timerAggregator interface {
+	Add(value float64)
+	Flush(bucket string) []Stat
+}
+
+// summaryAggregator estimates the configured quantiles over a decaying
+// window of recent samples. It keeps `ageBuckets` generations of samples;
+// the oldest generation is dropped and a fresh one started every
+// maxAge/ageBuckets, so any one sample influences the summary for at most
+// maxAge. This trades the precision of a true Cormode-Korlov biased
+// quantile sketch for a much simpler implementation: rather than a
+// dedicated (φ, ε) data structure per quantile, each QuantileSpec's Error
+// is used to size the single nearest-rank sample buffer this aggregator
+// keeps per age bucket, since that buffer's rank error is approximately
+// 1/bufferSize. The tightest Error across the configured quantiles wins,
+// so asking for a smaller error retains more samples (and more memory) in
+// exchange for a more accurate estimate.
+type summaryAggregator struct {
+	quantiles  []QuantileSpec
+	bufferSize int
+	generation []*list.List // one list.List of float64 samples per age bucket, newest first
+	rotatedAt  time.Time
+	bucketAge  time.Duration
+}
+
+func newSummaryAggregator(conf *TimerAggregationConfig, now time.Time) *summaryAggregator {
+	maxAge := conf.MaxAge
+	if maxAge <= 0 {
+		maxAge = 600
+	}
+	ageBuckets := conf.AgeBuckets
+	if ageBuckets <= 0 {
+		ageBuckets = 5
+	}
+	bufferSize := conf.StreamBufferSize
+	if bufferSize <= 0 {
+		bufferSize = 500
+	}
+	for _, q := range conf.Quantiles {
+		if q.Error > 0 {
+			if required := int(1 / q.Error); required > bufferSize {
+				bufferSize = required
+			}
+		}
+	}
+	sa := &summaryAggregator{
+		quantiles:  conf.Quantiles,
+		bufferSize: bufferSize,
+		generation: make([]*list.List, ageBuckets),
+		rotatedAt:  now,
+		bucketAge:  time.Duration(maxAge) * time.Second / time.Duration(ageBuckets),
+	}
+	for i := range sa.generation {
+		sa.generation[i] = list.New()
+	}
+	return sa
+}
+
+func (sa *summaryAggregator) rotate(now time.Time) {
+	for sa.bucketAge > 0 && now.Sub(sa.rotatedAt) >= sa.bucketAge {
+		copy(sa.generation[1:], sa.generation[:len(sa.generation)-1])
+		sa.generation[0] = list.New()
+		sa.rotatedAt = sa.rotatedAt.Add(sa.bucketAge)
+	}
+}
+
+func (sa *summaryAggregator) Add(value float64) {
+	head := sa.generation[0]
+	head.PushBack(value)
+	for head.Len() > sa.bufferSize {
+		head.Remove(head.Front())
+	}
+}
+
+func (sa *summaryAggregator) Flush(bucket string) []Stat {
+	var samples []float64
+	for _, gen := range sa.generation {
+		for e := gen.Front(); e != nil; e = e.Next() {
+			samples = append(samples, e.Value.(float64))
+		}
+	}
+	// Nothing has been observed yet; emitting quantiles over an empty
+	// window would just be NaN, so skip the flush entirely.
+	if len(samples) == 0 {
+		return nil
+	}
+	sort.Float64s(samples)
+
+	stats := make([]Stat, 0, len(sa.quantiles))
+	for _, q := range sa.quantiles {
+		rank := int(q.Quantile * float64(len(samples)-1))
+		stat := Stat{
+			Bucket:   fmt.Sprintf("%s.p%s", bucket, sanitizeBucketSuffix(q.Quantile*100)),
+			Value:    fmt.Sprintf("%g", samples[rank]),
+			Modifier: "g",
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+// sanitizeBucketSuffix renders a float for use as part of a graphite/carbon
+// style bucket name, where "." is a path separator: 99.5 needs to become
+// "99_5", not ".p99.5", which would otherwise silently fork the metric
+// hierarchy these derived stat names are meant to produce.
+func sanitizeBucketSuffix(f float64) string {
+	return strings.Replace(fmt.Sprintf("%g", f), ".", "_", -1)
+}
+
+// histogramAggregator keeps a cumulative count per configured bucket
+// boundary, plus the running sum and count, mirroring the shape a
+// Prometheus-style histogram exposes.
+type histogramAggregator struct {
+	bounds []float64
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newHistogramAggregator(conf *TimerAggregationConfig) *histogramAggregator {
+	bounds := make([]float64, len(conf.Buckets))
+	copy(bounds, conf.Buckets)
+	sort.Float64s(bounds)
+	return &histogramAggregator{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)),
+	}
+}
+
+func (ha *histogramAggregator) Add(value float64) {
+	ha.sum += value
+	ha.count++
+	for i, bound := range ha.bounds {
+		if value <= bound {
+			ha.counts[i]++
+		}
+	}
+}
+
+func (ha *histogramAggregator) Flush(bucket string) []Stat {
+	if ha.count == 0 {
+		return nil
+	}
+	// Key each bucket counter by its "le" tag alone, rather than also
+	// baking the bound into the bucket name; doing both would reintroduce
+	// the per-dimension bucket proliferation tags exist to eliminate.
+	stats := make([]Stat, 0, len(ha.bounds)+3)
+	for i, bound := range ha.bounds {
+		stats = append(stats, Stat{
+			Bucket:   bucket,
+			Value:    fmt.Sprintf("%d", ha.counts[i]),
+			Modifier: "",
+			Tags:     []string{fmt.Sprintf("le:%g", bound)},
+		})
+	}
+	// The implicit "+Inf" bucket always equals the total count, the same
+	// way it would in a Prometheus-style histogram, reconciling any sample
+	// above the largest configured bound with _count.
+	stats = append(stats, Stat{
+		Bucket:   bucket,
+		Value:    fmt.Sprintf("%d", ha.count),
+		Modifier: "",
+		Tags:     []string{"le:+Inf"},
+	})
+	stats = append(stats,
+		Stat{Bucket: bucket + "_sum", Value: fmt.Sprintf("%g", ha.sum), Modifier: ""},
+		Stat{Bucket: bucket + "_count", Value: fmt.Sprintf("%d", ha.count), Modifier: ""},
+	)
+	return stats
+}
+
+// aggregatorSet manages one timerAggregator per interpolated bucket name
+// for a single metric definition, bounding the total number of distinct
+// bucket names it will track so that a runaway cardinality source (e.g. a
+// bucket name templated on an unbounded capture) can't grow memory
+// without limit.
+type aggregatorSet struct {
+	conf        *TimerAggregationConfig
+	maxCard     int
+	aggregators map[string]*list.Element
+	lru         *list.List // front = most recently used
+}
+
+type aggregatorEntry struct {
+	bucket string
+	agg    timerAggregator
+}
+
+func newAggregatorSet(conf *TimerAggregationConfig) *aggregatorSet {
+	maxCardinality := conf.MaxCardinality
+	if maxCardinality <= 0 {
+		maxCardinality = 10000
+	}
+	return &aggregatorSet{
+		conf:        conf,
+		maxCard:     maxCardinality,
+		aggregators: make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+func (as *aggregatorSet) get(bucket string, now time.Time) timerAggregator {
+	if elem, ok := as.aggregators[bucket]; ok {
+		as.lru.MoveToFront(elem)
+		return elem.Value.(*aggregatorEntry).agg
+	}
+
+	var agg timerAggregator
+	if as.conf.isHistogram() {
+		agg = newHistogramAggregator(as.conf)
+	} else {
+		agg = newSummaryAggregator(as.conf, now)
+	}
+	elem := as.lru.PushFront(&aggregatorEntry{bucket: bucket, agg: agg})
+	as.aggregators[bucket] = elem
+
+	for as.lru.Len() > as.maxCard {
+		oldest := as.lru.Back()
+		as.lru.Remove(oldest)
+		delete(as.aggregators, oldest.Value.(*aggregatorEntry).bucket)
+	}
+	return agg
+}
+
+func (as *aggregatorSet) flushAll(now time.Time) []Stat {
+	var stats []Stat
+	for e := as.lru.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*aggregatorEntry)
+		if sa, ok := entry.agg.(*summaryAggregator); ok {
+			sa.rotate(now)
+		}
+		stats = append(stats, entry.agg.Flush(entry.bucket)...)
+	}
+	return stats
+}
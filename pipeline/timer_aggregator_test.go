@@ -0,0 +1,145 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Ben Bangert (bbangert@mozilla.com)
+#   Mike Trinkala (trink@mozilla.com)
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummaryAggregatorFlushEmptyIsNil(t *testing.T) {
+	conf := &TimerAggregationConfig{Quantiles: []QuantileSpec{{Quantile: 0.5}}}
+	sa := newSummaryAggregator(conf, time.Unix(0, 0))
+	if stats := sa.Flush("test.bucket"); stats != nil {
+		t.Errorf("expected nil stats before any sample is added, got %v", stats)
+	}
+}
+
+func TestSummaryAggregatorFlushQuantile(t *testing.T) {
+	conf := &TimerAggregationConfig{Quantiles: []QuantileSpec{{Quantile: 1}}}
+	sa := newSummaryAggregator(conf, time.Unix(0, 0))
+	for _, v := range []float64{1, 2, 3, 4, 5} {
+		sa.Add(v)
+	}
+	stats := sa.Flush("test.bucket")
+	if len(stats) != 1 {
+		t.Fatalf("expected 1 stat, got %d", len(stats))
+	}
+	if stats[0].Bucket != "test.bucket.p100" {
+		t.Errorf("expected bucket name 'test.bucket.p100', got %q", stats[0].Bucket)
+	}
+	if stats[0].Value != "5" {
+		t.Errorf("expected max value '5' for the p100, got %q", stats[0].Value)
+	}
+}
+
+func TestSummaryAggregatorRotateEvictsOldSamples(t *testing.T) {
+	// maxAge=10s split into 2 age buckets -> each generation covers 5s.
+	conf := &TimerAggregationConfig{
+		Quantiles:  []QuantileSpec{{Quantile: 1}},
+		MaxAge:     10,
+		AgeBuckets: 2,
+	}
+	start := time.Unix(0, 0)
+	sa := newSummaryAggregator(conf, start)
+	sa.Add(100)
+
+	// Advancing by less than one generation shouldn't evict anything.
+	sa.rotate(start.Add(2 * time.Second))
+	if stats := sa.Flush("bucket"); len(stats) != 1 || stats[0].Value != "100" {
+		t.Fatalf("sample should still be present after a partial generation, got %v", stats)
+	}
+
+	// Advancing past both generations should flush the old sample out
+	// entirely, leaving nothing to report.
+	sa.rotate(start.Add(11 * time.Second))
+	if stats := sa.Flush("bucket"); stats != nil {
+		t.Errorf("expected sample to have aged out, got %v", stats)
+	}
+}
+
+func TestHistogramAggregatorFlush(t *testing.T) {
+	conf := &TimerAggregationConfig{Buckets: []float64{1, 5}}
+	ha := newHistogramAggregator(conf)
+	ha.Add(0.5)
+	ha.Add(3)
+	ha.Add(10)
+
+	stats := ha.Flush("bucket")
+	byTag := make(map[string]string)
+	for _, s := range stats {
+		if s.Bucket != "bucket" && s.Bucket != "bucket_sum" && s.Bucket != "bucket_count" {
+			t.Errorf("unexpected bucket name %q; le bound must not be baked into it", s.Bucket)
+		}
+		if len(s.Tags) == 1 {
+			byTag[s.Tags[0]] = s.Value
+		}
+	}
+	if byTag["le:1"] != "1" {
+		t.Errorf("expected le:1 count to be 1, got %q", byTag["le:1"])
+	}
+	if byTag["le:5"] != "2" {
+		t.Errorf("expected le:5 cumulative count to be 2, got %q", byTag["le:5"])
+	}
+	if byTag["le:+Inf"] != "3" {
+		t.Errorf("expected le:+Inf count to equal total count 3, got %q", byTag["le:+Inf"])
+	}
+}
+
+func TestAggregatorSetEvictsLeastRecentlyUsed(t *testing.T) {
+	conf := &TimerAggregationConfig{Quantiles: []QuantileSpec{{Quantile: 0.5}}, MaxCardinality: 2}
+	as := newAggregatorSet(conf)
+	now := time.Unix(0, 0)
+
+	as.get("a", now).Add(1)
+	as.get("b", now).Add(1)
+	// Touch "a" so "b" becomes the least recently used.
+	as.get("a", now).Add(1)
+	// Adding a third bucket should evict "b", the least recently used.
+	as.get("c", now).Add(1)
+
+	if _, ok := as.aggregators["b"]; ok {
+		t.Errorf("expected least-recently-used bucket 'b' to be evicted")
+	}
+	if _, ok := as.aggregators["a"]; !ok {
+		t.Errorf("expected recently-touched bucket 'a' to still be tracked")
+	}
+	if _, ok := as.aggregators["c"]; !ok {
+		t.Errorf("expected newly added bucket 'c' to be tracked")
+	}
+	if as.lru.Len() != 2 {
+		t.Errorf("expected cardinality cap of 2 to be enforced, got %d", as.lru.Len())
+	}
+}
+
+func TestAggregatorSetFlushAllRotatesSummaries(t *testing.T) {
+	conf := &TimerAggregationConfig{
+		Quantiles:  []QuantileSpec{{Quantile: 1}},
+		MaxAge:     10,
+		AgeBuckets: 2,
+	}
+	as := newAggregatorSet(conf)
+	start := time.Unix(0, 0)
+	as.get("bucket", start).Add(42)
+
+	if stats := as.flushAll(start.Add(1 * time.Second)); len(stats) != 1 {
+		t.Fatalf("expected the fresh sample to still be reported, got %v", stats)
+	}
+	if stats := as.flushAll(start.Add(20 * time.Second)); stats != nil {
+		t.Errorf("expected the sample to have aged out after 20s, got %v", stats)
+	}
+}